@@ -4,22 +4,45 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"strings"
 
 	"github.com/go-ldap/ldap/v3"
 )
 
+// defaultSearchPageSize - the number of logins batched into a single search
+// request by FindUsers when Config.SearchPageSize is not set
+const defaultSearchPageSize = 100
+
+// defaultMaxConnections - the pool size used when Config.MaxConnections is
+// not set
+const defaultMaxConnections = 1
+
+// networkErrorMessage - the error ldap.v3 returns when a bind is attempted on
+// a connection the server has since closed
+const networkErrorMessage = `LDAP Result Code 200 "Network Error": ldap: connection closed`
+
+// Dialer - dials a plaintext connection. Defaults to ldap.Dial; override to
+// inject a fake connection in tests, or to resolve hosts via DNS SRV records.
+type Dialer func(network, addr string) (ldap.Client, error)
+
+// TLSDialer - dials an implicit TLS (LDAPS) connection. Defaults to
+// ldap.DialTLS; override alongside Dialer for the same reasons.
+type TLSDialer func(network, addr string, config *tls.Config) (ldap.Client, error)
+
 // LDAPClient - the ldap client interface
 type LDAPClient interface {
 	Bind() error
 	Authenticate(string, string) (bool, map[string]string, error)
+	AuthenticateUser(string, string) (bool, *UserInfo, error)
+	GetGroupsOfUser(string) ([]string, error)
 	Close()
 }
 
-// Client - the ldap client
+// Client - the ldap client. A Client holds a pool of connections and is safe
+// to share across goroutines.
 type Client struct {
-	Conn        ldap.Client
-	Config      *Config
-	disconnects int
+	Config *Config
+	pool   chan ldap.Client
 }
 
 // Config - ldap client config
@@ -29,129 +52,533 @@ type Config struct {
 	BindDN             string
 	BindPassword       string
 	GroupFilter        string // e.g. "(memberUid=%s)"
-	Host               string
-	UserFilter         string // e.g. "(uid=%s)"
+	GroupBase          string
+	GroupAttribute     string   // e.g. "cn"
+	UserGroupMatcher   string   // attribute on the user entry substituted into GroupFilter, e.g. "dn" or "uid". Defaults to the entry's DN.
+	Host               string   // deprecated: single-host form of Hosts
+	Hosts              []string // tried in order until one connects; falls back to Host if empty
+	UserFilter         string   // e.g. "(uid=%s)"
 	Port               int
+	SearchPageSize     int // max logins per batched FindUsers search, default 100
+	MaxConnections     int // size of the connection pool, default 1
 	InsecureSkipVerify bool
 	UseSSL             bool
+	UseStartTLS        bool              // upgrade a plaintext connection with StartTLS instead of dialing LDAPS
 	ClientCertificates []tls.Certificate // Adding client certificates
 	CACertificates     []byte
+	RootCAs            *x509.CertPool // pre-built CA pool, takes precedence over CACertificates
+	Dialer             Dialer         // overrides how plaintext/StartTLS connections are dialed
+	TLSDialer          TLSDialer      // overrides how LDAPS connections are dialed
+	ActiveDirectory    bool           // enables AD defaulting of UserFilter/Attributes and sAMAccountName/UPN resolution
+	ADDomain           string         // domain suffix used to build userPrincipalName when ActiveDirectory is set
+}
+
+// defaultADUserFilterTemplate - the UserFilter used in ActiveDirectory mode
+// when none is configured. %s is replaced with Config.ADDomain by userFilter;
+// the resulting string keeps a single %[1]s substitution point, filled in
+// later with the escaped, domain-stripped username.
+const defaultADUserFilterTemplate = `(&(objectClass=user)(|(sAMAccountName=%%[1]s)(userPrincipalName=%%[1]s@%s)))`
+
+// defaultADAttributes - the Attributes used in ActiveDirectory mode when none
+// are configured
+var defaultADAttributes = []string{"sAMAccountName", "mail", "userPrincipalName", "memberOf"}
+
+// userFilter - the filter to substitute a username into when searching for a
+// user, defaulting to defaultADUserFilterTemplate when Config.ActiveDirectory
+// is set and no UserFilter is configured
+func (c *Client) userFilter() string {
+	if c.Config.UserFilter != "" {
+		return c.Config.UserFilter
+	}
+	if c.Config.ActiveDirectory {
+		return fmt.Sprintf(defaultADUserFilterTemplate, c.Config.ADDomain)
+	}
+	return c.Config.UserFilter
+}
+
+// attributes - the user entry attributes to fetch, defaulting to
+// defaultADAttributes when Config.ActiveDirectory is set and none are
+// configured
+func (c *Client) attributes() []string {
+	if len(c.Config.Attributes) > 0 {
+		return c.Config.Attributes
+	}
+	if c.Config.ActiveDirectory {
+		return defaultADAttributes
+	}
+	return c.Config.Attributes
+}
+
+// adUsername - strips any "@domain" UPN suffix so the bare sAMAccountName can
+// be substituted into both clauses of the AD default filter
+func adUsername(username string) string {
+	if i := strings.Index(username, "@"); i >= 0 {
+		return username[:i]
+	}
+	return username
+}
+
+// UserInfo - the DN, attributes and group memberships of an authenticated user
+type UserInfo struct {
+	DN         string
+	Attributes map[string]string
+	Groups     []string
+}
+
+// provider - holds an immutable copy of the Config passed to New, so that a
+// caller mutating the Config they passed in cannot affect a Client already
+// under construction
+type provider struct {
+	config Config
+}
+
+func newProvider(config *Config) *provider {
+	frozen := *config
+	return &provider{config: frozen}
 }
 
 // New - Creates a new ldap client
 func New(config *Config) (*Client, error) {
-	client := &Client{Config: config}
-	if err := client.connect(); err != nil {
-		return &Client{}, err
+	p := newProvider(config)
+	client := &Client{Config: &p.config}
+
+	poolSize := client.Config.MaxConnections
+	if poolSize <= 0 {
+		poolSize = defaultMaxConnections
+	}
+	client.pool = make(chan ldap.Client, poolSize)
+
+	for i := 0; i < poolSize; i++ {
+		conn, err := client.connect()
+		if err != nil {
+			return &Client{}, err
+		}
+		client.pool <- conn
 	}
+
 	if err := client.Bind(); err != nil {
 		return &Client{}, err
 	}
 	return client, nil
 }
 
-func (c *Client) connect() error {
-	var (
-		ldapConn *ldap.Conn
-		err      error
-	)
-	c.Close()
-	address := fmt.Sprintf("%s:%d", c.Config.Host, c.Config.Port)
-	if c.Config.UseSSL {
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: c.Config.InsecureSkipVerify,
-			ServerName:         c.Config.Host,
-		}
-		if len(c.Config.CACertificates) > 0 {
-			tlsConfig.RootCAs = x509.NewCertPool()
-			if !tlsConfig.RootCAs.AppendCertsFromPEM(c.Config.CACertificates) {
-				return fmt.Errorf("Could not append CA certs from PEM")
-			}
+// connect - dials the configured Hosts in order, returning the first
+// successful connection. Each host is tried once; the last error is
+// returned if none succeed.
+func (c *Client) connect() (ldap.Client, error) {
+	var err error
+	for _, host := range c.hosts() {
+		var conn ldap.Client
+		if conn, err = c.dial(host); err == nil {
+			return conn, nil
 		}
-		if c.Config.ClientCertificates != nil && len(c.Config.ClientCertificates) > 0 {
-			tlsConfig.Certificates = c.Config.ClientCertificates
+	}
+	return nil, err
+}
+
+// hosts - the configured Hosts, falling back to the single deprecated Host,
+// and finally to a single empty host so an unconfigured Client dials and
+// fails the same way it always has rather than erroring out early
+func (c *Client) hosts() []string {
+	if len(c.Config.Hosts) > 0 {
+		return c.Config.Hosts
+	}
+	if c.Config.Host != "" {
+		return []string{c.Config.Host}
+	}
+	return []string{""}
+}
+
+func (c *Client) dial(host string) (ldap.Client, error) {
+	address := fmt.Sprintf("%s:%d", host, c.Config.Port)
+
+	if c.Config.UseStartTLS {
+		conn, err := c.dialPlain(address)
+		if err != nil {
+			return nil, err
 		}
-		ldapConn, err = ldap.DialTLS("tcp", address, tlsConfig)
+		tlsConfig, err := c.tlsConfig(host)
 		if err != nil {
-			return err
+			conn.Close()
+			return nil, err
 		}
-	} else {
-		ldapConn, err = ldap.Dial("tcp", address)
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	if c.Config.UseSSL {
+		tlsConfig, err := c.tlsConfig(host)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return c.dialTLS(address, tlsConfig)
 	}
-	c.Conn = ldapConn
-	return nil
+
+	return c.dialPlain(address)
+}
+
+func (c *Client) dialPlain(address string) (ldap.Client, error) {
+	if c.Config.Dialer != nil {
+		return c.Config.Dialer("tcp", address)
+	}
+	return ldap.Dial("tcp", address)
+}
+
+func (c *Client) dialTLS(address string, tlsConfig *tls.Config) (ldap.Client, error) {
+	if c.Config.TLSDialer != nil {
+		return c.Config.TLSDialer("tcp", address, tlsConfig)
+	}
+	return ldap.DialTLS("tcp", address, tlsConfig)
+}
+
+// tlsConfig - builds the tls.Config shared by UseSSL and UseStartTLS
+func (c *Client) tlsConfig(host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.Config.InsecureSkipVerify,
+		ServerName:         host,
+	}
+	if c.Config.RootCAs != nil {
+		tlsConfig.RootCAs = c.Config.RootCAs
+	} else if len(c.Config.CACertificates) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(c.Config.CACertificates) {
+			return nil, fmt.Errorf("Could not append CA certs from PEM")
+		}
+	}
+	if c.Config.ClientCertificates != nil && len(c.Config.ClientCertificates) > 0 {
+		tlsConfig.Certificates = c.Config.ClientCertificates
+	}
+	return tlsConfig, nil
+}
+
+// acquire - borrows a connection from the pool, blocking until one is free
+func (c *Client) acquire() (ldap.Client, error) {
+	conn := <-c.pool
+	if conn == nil {
+		return c.connect()
+	}
+	return conn, nil
+}
+
+// release - returns a borrowed connection to the pool
+func (c *Client) release(conn ldap.Client) {
+	c.pool <- conn
+}
+
+// bind - binds conn as username/password, reconnecting the borrowed
+// connection once if the server has closed it in the meantime
+func (c *Client) bind(conn ldap.Client, username, password string) (ldap.Client, error) {
+	if err := conn.Bind(username, password); err != nil {
+		if err.Error() != networkErrorMessage {
+			return conn, err
+		}
+
+		conn.Close()
+		newConn, dialErr := c.connect()
+		if dialErr != nil {
+			return newConn, dialErr
+		}
+		if err := newConn.Bind(username, password); err != nil {
+			return newConn, err
+		}
+		return newConn, nil
+	}
+	return conn, nil
+}
+
+// bindService - binds conn as the configured service account, validating
+// that BindDN/BindPassword are set first
+func (c *Client) bindService(conn ldap.Client) (ldap.Client, error) {
+	if c.Config.BindDN == "" || c.Config.BindPassword == "" {
+		return conn, fmt.Errorf("BindDN or BindPassword was not set on Client config")
+	}
+	return c.bind(conn, c.Config.BindDN, c.Config.BindPassword)
 }
 
 // Bind - bind to LDAP as the Config user
 func (c *Client) Bind() error {
-	if c.Config.BindDN != "" && c.Config.BindPassword != "" {
-		if err := c.Conn.Bind(c.Config.BindDN, c.Config.BindPassword); err != nil {
-			if err.Error() == `LDAP Result Code 200 "Network Error": ldap: connection closed` {
-				c.disconnects++
-				if c.disconnects < 2 {
-					if err := c.connect(); err != nil {
-						return err
-					}
-					return c.Bind()
-				}
-			}
-			return err
-		}
-		c.disconnects = 0
-		return nil
+	conn, err := c.acquire()
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("BindDN or BindPassword was not set on Client config")
+	conn, err = c.bindService(conn)
+	c.release(conn)
+	return err
 }
 
-// Close - close the backend ldap connection
+// Close - closes every connection currently in the pool
 func (c *Client) Close() {
-	if c.Conn != nil {
-		c.Conn.Close()
-		c.Conn = nil
+	for {
+		select {
+		case conn := <-c.pool:
+			if conn != nil {
+				conn.Close()
+			}
+		default:
+			return
+		}
 	}
 }
 
 // Authenticate - authenticates a user against ldap
 func (c *Client) Authenticate(username, password string) (bool, map[string]string, error) {
-	defer c.Bind()
-	if err := c.Bind(); err != nil {
+	if username == "" || password == "" {
+		return false, nil, nil
+	}
+
+	conn, err := c.acquire()
+	if err != nil {
 		return false, nil, err
 	}
-	attributes := append(c.Config.Attributes, "dn")
-	// Search for the given username
+	defer func() { c.release(conn) }()
+
+	if conn, err = c.bindService(conn); err != nil {
+		return false, nil, err
+	}
+
+	entry, err := c.searchUser(conn, username)
+	if err != nil {
+		if err == ErrUserNotFound {
+			return false, nil, nil
+		}
+		return false, nil, err
+	}
+
+	user := map[string]string{}
+	for _, attr := range c.attributes() {
+		if attr == "memberOf" {
+			user[attr] = strings.Join(entry.GetAttributeValues(attr), ",")
+			continue
+		}
+		user[attr] = entry.GetAttributeValue(attr)
+	}
+
+	// Bind as the user to verify their password
+	if conn, err = c.bind(conn, entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return false, nil, nil
+		}
+		return false, user, err
+	}
+	return true, user, nil
+}
+
+// AuthenticateUser - authenticates a user against ldap and returns their DN,
+// attributes and group memberships. Authenticate is kept for backwards compatibility.
+func (c *Client) AuthenticateUser(username, password string) (bool, *UserInfo, error) {
+	if username == "" || password == "" {
+		return false, nil, nil
+	}
+
+	conn, err := c.acquire()
+	if err != nil {
+		return false, nil, err
+	}
+	defer func() { c.release(conn) }()
+
+	if conn, err = c.bindService(conn); err != nil {
+		return false, nil, err
+	}
+
+	entry, err := c.searchUser(conn, username)
+	if err != nil {
+		if err == ErrUserNotFound {
+			return false, nil, nil
+		}
+		return false, nil, err
+	}
+
+	user := &UserInfo{
+		DN:         entry.DN,
+		Attributes: map[string]string{},
+	}
+	for _, attr := range c.attributes() {
+		if attr == "memberOf" {
+			user.Attributes[attr] = strings.Join(entry.GetAttributeValues(attr), ",")
+			continue
+		}
+		user.Attributes[attr] = entry.GetAttributeValue(attr)
+	}
+
+	// Bind as the user to verify their password
+	if conn, err = c.bind(conn, entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return false, nil, nil
+		}
+		return false, user, err
+	}
+
+	// In ActiveDirectory mode, group membership is read off the user entry's
+	// memberOf attribute rather than a separate GroupBase search, unless the
+	// caller has configured one explicitly.
+	var groups []string
+	if c.Config.ActiveDirectory && c.Config.GroupBase == "" {
+		groups = entry.GetAttributeValues("memberOf")
+	} else {
+		groups, err = c.groupsForEntry(conn, entry)
+		if err != nil {
+			return false, user, err
+		}
+	}
+	user.Groups = groups
+
+	return true, user, nil
+}
+
+// GetGroupsOfUser - looks up a user and returns the groups they belong to, by
+// substituting their UserGroupMatcher attribute (or DN) into GroupFilter and
+// searching GroupBase
+func (c *Client) GetGroupsOfUser(username string) ([]string, error) {
+	conn, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { c.release(conn) }()
+
+	if conn, err = c.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	entry, err := c.searchUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.groupsForEntry(conn, entry)
+}
+
+// ErrUserNotFound - returned by searchUser when no entry matches UserFilter.
+// Authenticate and AuthenticateUser treat this as a failed login rather than
+// an operational error.
+var ErrUserNotFound = fmt.Errorf("User does not exist")
+
+// searchUser - finds the single ldap entry matching UserFilter for username.
+// In ActiveDirectory mode, username may be a bare sAMAccountName or a
+// user@domain UPN; any UPN suffix is stripped before substitution.
+func (c *Client) searchUser(conn ldap.Client, username string) (*ldap.Entry, error) {
+	if c.Config.ActiveDirectory {
+		username = adUsername(username)
+	}
+
+	attributes := append(c.attributes(), "dn")
 	searchRequest := ldap.NewSearchRequest(
 		c.Config.Base,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf(c.Config.UserFilter, username),
+		fmt.Sprintf(c.userFilter(), EscapeFilter(username)),
 		attributes,
 		nil,
 	)
 
-	sr, err := c.Conn.Search(searchRequest)
+	sr, err := conn.Search(searchRequest)
 	if err != nil {
-		return false, nil, err
+		return nil, err
 	}
 
 	if len(sr.Entries) < 1 {
-		return false, nil, fmt.Errorf("User does not exist")
+		return nil, ErrUserNotFound
 	}
 
 	if len(sr.Entries) > 1 {
-		return false, nil, fmt.Errorf("Too many entries returned")
+		return nil, fmt.Errorf("Too many entries returned")
 	}
 
-	userDN := sr.Entries[0].DN
-	user := map[string]string{}
-	for _, attr := range c.Config.Attributes {
-		user[attr] = sr.Entries[0].GetAttributeValue(attr)
+	return sr.Entries[0], nil
+}
+
+// groupsForEntry - performs the GroupFilter search for a given user entry
+func (c *Client) groupsForEntry(conn ldap.Client, entry *ldap.Entry) ([]string, error) {
+	matcherValue := entry.DN
+	if c.Config.UserGroupMatcher != "" && !strings.EqualFold(c.Config.UserGroupMatcher, "dn") {
+		matcherValue = entry.GetAttributeValue(c.Config.UserGroupMatcher)
 	}
 
-	// Bind as the user to verify their password
-	if err := c.Conn.Bind(userDN, password); err != nil {
-		return false, user, err
+	searchRequest := ldap.NewSearchRequest(
+		c.Config.GroupBase,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(c.Config.GroupFilter, EscapeFilter(matcherValue)),
+		[]string{c.Config.GroupAttribute},
+		nil,
+	)
+
+	sr, err := conn.Search(searchRequest)
+	if err != nil {
+		return nil, err
 	}
-	return true, user, nil
+
+	groups := make([]string, 0, len(sr.Entries))
+	for _, groupEntry := range sr.Entries {
+		groups = append(groups, groupEntry.GetAttributeValue(c.Config.GroupAttribute))
+	}
+	return groups, nil
+}
+
+// EscapeFilter - escapes a value for safe substitution into an ldap filter,
+// per RFC 4515 (backslash, asterisk, parentheses, NUL and any non-ASCII byte)
+func EscapeFilter(value string) string {
+	return ldap.EscapeFilter(value)
+}
+
+// FindUsers - looks up multiple logins in as few search requests as possible
+// by OR-ing them into the configured UserFilter, in batches of
+// Config.SearchPageSize logins (default 100) to avoid exceeding the server's
+// sizeLimit, and aggregates the results
+func (c *Client) FindUsers(logins []string) ([]*ldap.Entry, error) {
+	conn, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { c.release(conn) }()
+
+	if conn, err = c.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	pageSize := c.Config.SearchPageSize
+	if pageSize <= 0 {
+		pageSize = defaultSearchPageSize
+	}
+
+	entries := []*ldap.Entry{}
+	for start := 0; start < len(logins); start += pageSize {
+		end := start + pageSize
+		if end > len(logins) {
+			end = len(logins)
+		}
+
+		sr, err := conn.Search(c.findUsersSearchRequest(logins[start:end]))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, sr.Entries...)
+	}
+
+	return entries, nil
+}
+
+// findUsersSearchRequest - builds a single search request that ORs together
+// the UserFilter for each of the given logins
+func (c *Client) findUsersSearchRequest(logins []string) *ldap.SearchRequest {
+	userFilter := c.userFilter()
+
+	var filter strings.Builder
+	filter.WriteString("(|")
+	for _, login := range logins {
+		if c.Config.ActiveDirectory {
+			login = adUsername(login)
+		}
+		filter.WriteString(fmt.Sprintf(userFilter, EscapeFilter(login)))
+	}
+	filter.WriteString(")")
+
+	attributes := append(c.attributes(), "dn")
+	return ldap.NewSearchRequest(
+		c.Config.Base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter.String(),
+		attributes,
+		nil,
+	)
 }
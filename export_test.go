@@ -0,0 +1,13 @@
+package ldapClient
+
+import "github.com/go-ldap/ldap/v3"
+
+// NewTestClient builds a Client backed by the given connections instead of
+// real network dials, for use by this package's external tests only.
+func NewTestClient(config *Config, conns ...ldap.Client) *Client {
+	pool := make(chan ldap.Client, len(conns))
+	for _, conn := range conns {
+		pool <- conn
+	}
+	return &Client{Config: config, pool: pool}
+}
@@ -3,6 +3,7 @@ package ldapClient_test
 import (
 	"crypto/tls"
 	"fmt"
+	"strings"
 
 	. "github.com/FidelityInternational/go-ldap-client"
 	"github.com/go-ldap/ldap/v3"
@@ -17,7 +18,9 @@ type fakeConn struct {
 	mock.Mock
 }
 
-func (fc *fakeConn) Close() {}
+func (fc *fakeConn) Close() {
+	fc.Called()
+}
 
 func (fc *fakeConn) Bind(username, password string) error {
 	args := fc.Called(username, password)
@@ -40,6 +43,14 @@ func (fc *fakeConn) fakeSearch(searchRes *ldap.SearchResult, err error) {
 	fc.On("Search", mock.AnythingOfType("*ldap.SearchRequest")).Return(searchRes, err)
 }
 
+// fakeSearchForBase stubs a Search response for requests against a specific
+// base DN, allowing a user search and a group search to be stubbed separately
+func (fc *fakeConn) fakeSearchForBase(base string, searchRes *ldap.SearchResult, err error) {
+	fc.On("Search", mock.MatchedBy(func(req *ldap.SearchRequest) bool {
+		return req.BaseDN == base
+	})).Return(searchRes, err)
+}
+
 var singleUser = &ldap.SearchResult{
 	Entries: []*ldap.Entry{
 		{
@@ -61,6 +72,31 @@ var multiUser = &ldap.SearchResult{
 
 var noUser = &ldap.SearchResult{}
 
+var adUser = &ldap.SearchResult{
+	Entries: []*ldap.Entry{
+		{
+			DN: "dn1",
+			Attributes: []*ldap.EntryAttribute{
+				{Name: "sAMAccountName", Values: []string{"jbloggs"}},
+				{Name: "memberOf", Values: []string{"cn=admins,ou=groups,dc=example,dc=com", "cn=devs,ou=groups,dc=example,dc=com"}},
+			},
+		},
+	},
+}
+
+var groupResult = &ldap.SearchResult{
+	Entries: []*ldap.Entry{
+		{
+			DN:         "cn=admins,ou=groups,dc=example,dc=com",
+			Attributes: []*ldap.EntryAttribute{{Name: "cn", Values: []string{"admins"}}},
+		},
+		{
+			DN:         "cn=devs,ou=groups,dc=example,dc=com",
+			Attributes: []*ldap.EntryAttribute{{Name: "cn", Values: []string{"devs"}}},
+		},
+	},
+}
+
 var _ = Describe("GoLdapClient", func() {
 	Describe("#New", func() {
 		var (
@@ -138,16 +174,98 @@ var _ = Describe("GoLdapClient", func() {
 				})
 			})
 		})
+
+		Context("when StartTLS is set", func() {
+			Context("and connecting to the server fails", func() {
+				BeforeEach(func() {
+					config = &Config{
+						UseStartTLS:        true,
+						InsecureSkipVerify: true,
+						Host:               "fake.localhost",
+						BindDN:             "username",
+						BindPassword:       "password",
+					}
+				})
+
+				It("returns an error", func() {
+					Ω(err).ShouldNot(BeNil())
+					Ω(err.Error()).Should(MatchRegexp("LDAP Result Code 200.*"))
+					Ω(client).Should(Equal(&Client{}))
+				})
+			})
+		})
+
+		Context("when a Dialer is configured", func() {
+			BeforeEach(func() {
+				fakeConnection := setFakeConn(nil)
+				config = &Config{
+					Host:         "ignored.example.com",
+					BindDN:       "magicUser",
+					BindPassword: "password",
+					Dialer: func(network, addr string) (ldap.Client, error) {
+						return fakeConnection, nil
+					},
+				}
+			})
+
+			It("uses the dialer instead of dialing the network", func() {
+				Ω(err).Should(BeNil())
+			})
+		})
+
+		Context("when multiple Hosts are configured", func() {
+			Context("and the first host's dialer fails", func() {
+				BeforeEach(func() {
+					fakeConnection := setFakeConn(nil)
+					config = &Config{
+						Hosts:        []string{"bad.example.com", "good.example.com"},
+						BindDN:       "magicUser",
+						BindPassword: "password",
+						Dialer: func(network, addr string) (ldap.Client, error) {
+							if strings.Contains(addr, "bad") {
+								return nil, fmt.Errorf("dial failed")
+							}
+							return fakeConnection, nil
+						},
+					}
+				})
+
+				It("falls over to the next host", func() {
+					Ω(err).Should(BeNil())
+				})
+			})
+
+			Context("and every host's dialer fails", func() {
+				BeforeEach(func() {
+					config = &Config{
+						Hosts:        []string{"bad1.example.com", "bad2.example.com"},
+						BindDN:       "magicUser",
+						BindPassword: "password",
+						Dialer: func(network, addr string) (ldap.Client, error) {
+							return nil, fmt.Errorf("dial failed")
+						},
+					}
+				})
+
+				It("returns the last dial error", func() {
+					Ω(err).Should(MatchError("dial failed"))
+				})
+			})
+		})
 	})
 
 	Describe("#Close", func() {
-		It("closes the backend ldap connection", func() {
-			client := Client{
-				Conn: &fakeConn{},
-			}
-			Ω(client.Conn).Should(Equal(&fakeConn{}))
+		It("closes every connection currently in the pool", func() {
+			conn1 := &fakeConn{}
+			conn1.On("Close").Return()
+			conn2 := &fakeConn{}
+			conn2.On("Close").Return()
+
+			client := NewTestClient(&Config{}, conn1, conn2)
 			client.Close()
-			Ω(client.Conn).Should(BeNil())
+
+			conn1.AssertCalled(GinkgoT(), "Close")
+			conn2.AssertCalled(GinkgoT(), "Close")
 		})
 	})
 
@@ -164,10 +282,7 @@ var _ = Describe("GoLdapClient", func() {
 				BindDN:       bindDN,
 				BindPassword: bindPassword,
 			}
-			client := &Client{
-				Conn:   fakeConnection,
-				Config: config,
-			}
+			client := NewTestClient(config, fakeConnection)
 			err = client.Bind()
 		})
 
@@ -235,22 +350,57 @@ var _ = Describe("GoLdapClient", func() {
 			authenticated  bool
 			user           map[string]string
 			err            error
-			bindDN         = "magicUser"
-			bindPassword   = "password"
 			fakeConnection *fakeConn
+			config         *Config
+			username       = "authUsername"
+			password       = "password"
 		)
 
 		JustBeforeEach(func() {
-			client := &Client{
-				Conn: fakeConnection,
-				Config: &Config{
-					BindDN:       bindDN,
-					BindPassword: bindPassword,
-					Attributes:   []string{"attribute1"},
-				},
-			}
+			client := NewTestClient(config, fakeConnection)
 			Ω(client.Bind()).Should(BeNil())
-			authenticated, user, err = client.Authenticate("authUsername", "password")
+			authenticated, user, err = client.Authenticate(username, password)
+		})
+
+		AfterEach(func() {
+			username = "authUsername"
+			password = "password"
+		})
+
+		BeforeEach(func() {
+			config = &Config{
+				BindDN:       "magicUser",
+				BindPassword: "password",
+				Attributes:   []string{"attribute1"},
+			}
+		})
+
+		Context("when the username is empty", func() {
+			BeforeEach(func() {
+				username = ""
+				fakeConnection = setFakeConn(nil)
+			})
+
+			It("returns authenticated false with no error, without issuing an ldap request", func() {
+				Ω(err).Should(BeNil())
+				Ω(authenticated).Should(BeFalse())
+				Ω(user).Should(BeNil())
+				fakeConnection.AssertNotCalled(GinkgoT(), "Search", mock.AnythingOfType("*ldap.SearchRequest"))
+			})
+		})
+
+		Context("when the password is empty", func() {
+			BeforeEach(func() {
+				password = ""
+				fakeConnection = setFakeConn(nil)
+			})
+
+			It("returns authenticated false with no error, without issuing an ldap request", func() {
+				Ω(err).Should(BeNil())
+				Ω(authenticated).Should(BeFalse())
+				Ω(user).Should(BeNil())
+				fakeConnection.AssertNotCalled(GinkgoT(), "Search", mock.AnythingOfType("*ldap.SearchRequest"))
+			})
 		})
 
 		Context("and the ldap search fails", func() {
@@ -273,8 +423,8 @@ var _ = Describe("GoLdapClient", func() {
 					fakeConnection.fakeSearch(noUser, nil)
 				})
 
-				It("returns an error", func() {
-					Ω(err).Should(MatchError("User does not exist"))
+				It("returns authenticated false with no error", func() {
+					Ω(err).Should(BeNil())
 					Ω(authenticated).Should(BeFalse())
 					Ω(user).Should(BeNil())
 				})
@@ -295,6 +445,19 @@ var _ = Describe("GoLdapClient", func() {
 
 			Context("and the ldap search returned exactly 1 results", func() {
 				Context("and the password is incorrect", func() {
+					BeforeEach(func() {
+						fakeConnection = setFakeConn(ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("invalid credentials")))
+						fakeConnection.fakeSearch(singleUser, nil)
+					})
+
+					It("returns authenticated false with no error, and no user", func() {
+						Ω(err).Should(BeNil())
+						Ω(authenticated).Should(BeFalse())
+						Ω(user).Should(BeNil())
+					})
+				})
+
+				Context("and the bind fails for an operational reason", func() {
 					BeforeEach(func() {
 						fakeConnection = setFakeConn(fmt.Errorf("ldap bind failed"))
 						fakeConnection.fakeSearch(singleUser, nil)
@@ -321,5 +484,291 @@ var _ = Describe("GoLdapClient", func() {
 				})
 			})
 		})
+
+		Context("when ActiveDirectory mode is enabled", func() {
+			BeforeEach(func() {
+				config = &Config{
+					BindDN:          "magicUser",
+					BindPassword:    "password",
+					ActiveDirectory: true,
+					ADDomain:        "example.com",
+				}
+				username = "jbloggs@example.com"
+				fakeConnection = setFakeConn(nil)
+				fakeConnection.fakeSearch(adUser, nil)
+			})
+
+			It("resolves the UPN, defaults the attributes and joins memberOf", func() {
+				Ω(err).Should(BeNil())
+				Ω(authenticated).Should(BeTrue())
+				Ω(user).Should(Equal(map[string]string{
+					"sAMAccountName":    "jbloggs",
+					"mail":              "",
+					"userPrincipalName": "",
+					"memberOf":          "cn=admins,ou=groups,dc=example,dc=com,cn=devs,ou=groups,dc=example,dc=com",
+				}))
+			})
+		})
+	})
+
+	Describe("#GetGroupsOfUser", func() {
+		var (
+			groups         []string
+			err            error
+			fakeConnection *fakeConn
+			config         *Config
+		)
+
+		JustBeforeEach(func() {
+			client := NewTestClient(config, fakeConnection)
+			groups, err = client.GetGroupsOfUser("authUsername")
+		})
+
+		BeforeEach(func() {
+			config = &Config{
+				BindDN:         "magicUser",
+				BindPassword:   "password",
+				Base:           "ou=users,dc=example,dc=com",
+				UserFilter:     "(uid=%s)",
+				GroupBase:      "ou=groups,dc=example,dc=com",
+				GroupFilter:    "(member=%s)",
+				GroupAttribute: "cn",
+			}
+		})
+
+		Context("and the user does not exist", func() {
+			BeforeEach(func() {
+				fakeConnection = setFakeConn(nil)
+				fakeConnection.fakeSearch(noUser, nil)
+			})
+
+			It("returns an error", func() {
+				Ω(err).Should(MatchError("User does not exist"))
+				Ω(groups).Should(BeNil())
+			})
+		})
+
+		Context("and the user exists", func() {
+			BeforeEach(func() {
+				fakeConnection = setFakeConn(nil)
+				fakeConnection.fakeSearchForBase(config.Base, singleUser, nil)
+				fakeConnection.fakeSearchForBase(config.GroupBase, groupResult, nil)
+			})
+
+			It("returns the groups the user belongs to", func() {
+				Ω(err).Should(BeNil())
+				Ω(groups).Should(Equal([]string{"admins", "devs"}))
+			})
+		})
+	})
+
+	Describe("#AuthenticateUser", func() {
+		var (
+			authenticated  bool
+			user           *UserInfo
+			err            error
+			fakeConnection *fakeConn
+			config         *Config
+			username       = "authUsername"
+			password       = "password"
+		)
+
+		JustBeforeEach(func() {
+			client := NewTestClient(config, fakeConnection)
+			authenticated, user, err = client.AuthenticateUser(username, password)
+		})
+
+		AfterEach(func() {
+			username = "authUsername"
+			password = "password"
+		})
+
+		BeforeEach(func() {
+			config = &Config{
+				BindDN:         "magicUser",
+				BindPassword:   "password",
+				Attributes:     []string{"attribute1"},
+				Base:           "ou=users,dc=example,dc=com",
+				UserFilter:     "(uid=%s)",
+				GroupBase:      "ou=groups,dc=example,dc=com",
+				GroupFilter:    "(member=%s)",
+				GroupAttribute: "cn",
+			}
+		})
+
+		Context("when the username is empty", func() {
+			BeforeEach(func() {
+				username = ""
+				fakeConnection = setFakeConn(nil)
+			})
+
+			It("returns authenticated false with no error, without issuing an ldap request", func() {
+				Ω(err).Should(BeNil())
+				Ω(authenticated).Should(BeFalse())
+				Ω(user).Should(BeNil())
+				fakeConnection.AssertNotCalled(GinkgoT(), "Search", mock.AnythingOfType("*ldap.SearchRequest"))
+			})
+		})
+
+		Context("when the password is empty", func() {
+			BeforeEach(func() {
+				password = ""
+				fakeConnection = setFakeConn(nil)
+			})
+
+			It("returns authenticated false with no error, without issuing an ldap request", func() {
+				Ω(err).Should(BeNil())
+				Ω(authenticated).Should(BeFalse())
+				Ω(user).Should(BeNil())
+				fakeConnection.AssertNotCalled(GinkgoT(), "Search", mock.AnythingOfType("*ldap.SearchRequest"))
+			})
+		})
+
+		Context("and the password is correct", func() {
+			BeforeEach(func() {
+				fakeConnection = setFakeConn(nil)
+				fakeConnection.fakeSearchForBase(config.Base, singleUser, nil)
+				fakeConnection.fakeSearchForBase(config.GroupBase, groupResult, nil)
+			})
+
+			It("returns authenticated true and the user's attributes and groups", func() {
+				Ω(err).Should(BeNil())
+				Ω(authenticated).Should(BeTrue())
+				Ω(user.DN).Should(Equal("dn1"))
+				Ω(user.Attributes).Should(Equal(map[string]string{"attribute1": ""}))
+				Ω(user.Groups).Should(Equal([]string{"admins", "devs"}))
+			})
+		})
+
+		Context("and the password is incorrect", func() {
+			BeforeEach(func() {
+				fakeConnection = setFakeConn(ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("invalid credentials")))
+				fakeConnection.fakeSearchForBase(config.Base, singleUser, nil)
+			})
+
+			It("returns authenticated false with no error, and no user", func() {
+				Ω(err).Should(BeNil())
+				Ω(authenticated).Should(BeFalse())
+				Ω(user).Should(BeNil())
+			})
+		})
+
+		Context("and the bind fails for an operational reason", func() {
+			BeforeEach(func() {
+				fakeConnection = setFakeConn(fmt.Errorf("ldap bind failed"))
+				fakeConnection.fakeSearchForBase(config.Base, singleUser, nil)
+			})
+
+			It("returns an error and the user that was found, without groups", func() {
+				Ω(err).Should(MatchError("ldap bind failed"))
+				Ω(authenticated).Should(BeFalse())
+				Ω(user.DN).Should(Equal("dn1"))
+				Ω(user.Groups).Should(BeNil())
+			})
+		})
+
+		Context("and the user does not exist", func() {
+			BeforeEach(func() {
+				fakeConnection = setFakeConn(nil)
+				fakeConnection.fakeSearchForBase(config.Base, noUser, nil)
+			})
+
+			It("returns authenticated false with no error, and no user", func() {
+				Ω(err).Should(BeNil())
+				Ω(authenticated).Should(BeFalse())
+				Ω(user).Should(BeNil())
+			})
+		})
+
+		Context("when ActiveDirectory mode is enabled and no GroupBase is configured", func() {
+			BeforeEach(func() {
+				config = &Config{
+					BindDN:          "magicUser",
+					BindPassword:    "password",
+					ActiveDirectory: true,
+					ADDomain:        "example.com",
+				}
+				fakeConnection = setFakeConn(nil)
+				fakeConnection.fakeSearch(adUser, nil)
+			})
+
+			It("returns groups read off the user entry's memberOf attribute", func() {
+				Ω(err).Should(BeNil())
+				Ω(authenticated).Should(BeTrue())
+				Ω(user.Groups).Should(Equal([]string{"cn=admins,ou=groups,dc=example,dc=com", "cn=devs,ou=groups,dc=example,dc=com"}))
+			})
+		})
+	})
+
+	Describe("#EscapeFilter", func() {
+		It("escapes RFC 4515 special characters", func() {
+			Ω(EscapeFilter(`a\*()b`)).Should(Equal(`a\5c\2a\28\29b`))
+		})
+
+		It("leaves ordinary values untouched", func() {
+			Ω(EscapeFilter("jbloggs")).Should(Equal("jbloggs"))
+		})
+	})
+
+	Describe("#FindUsers", func() {
+		var (
+			entries        []*ldap.Entry
+			err            error
+			fakeConnection *fakeConn
+			config         *Config
+		)
+
+		JustBeforeEach(func() {
+			client := NewTestClient(config, fakeConnection)
+			entries, err = client.FindUsers([]string{"alice", "bob", "carol"})
+		})
+
+		BeforeEach(func() {
+			config = &Config{
+				BindDN:       "magicUser",
+				BindPassword: "password",
+				Base:         "ou=users,dc=example,dc=com",
+				UserFilter:   "(uid=%s)",
+			}
+		})
+
+		Context("and the number of logins fits within the default page size", func() {
+			BeforeEach(func() {
+				fakeConnection = setFakeConn(nil)
+				fakeConnection.fakeSearch(multiUser, nil)
+			})
+
+			It("issues a single OR'd search and returns the aggregated entries", func() {
+				Ω(err).Should(BeNil())
+				Ω(entries).Should(Equal(multiUser.Entries))
+				fakeConnection.AssertNumberOfCalls(GinkgoT(), "Search", 1)
+			})
+		})
+
+		Context("and the number of logins exceeds Config.SearchPageSize", func() {
+			BeforeEach(func() {
+				config.SearchPageSize = 2
+				fakeConnection = setFakeConn(nil)
+				fakeConnection.fakeSearch(singleUser, nil)
+			})
+
+			It("splits the search into multiple batched requests", func() {
+				Ω(err).Should(BeNil())
+				Ω(entries).Should(HaveLen(2))
+				fakeConnection.AssertNumberOfCalls(GinkgoT(), "Search", 2)
+			})
+		})
+
+		Context("and the search fails", func() {
+			BeforeEach(func() {
+				fakeConnection = setFakeConn(nil)
+				fakeConnection.fakeSearch(noUser, fmt.Errorf("failed ldap search"))
+			})
+
+			It("returns an error", func() {
+				Ω(err).Should(MatchError("failed ldap search"))
+				Ω(entries).Should(BeNil())
+			})
+		})
 	})
 })